@@ -0,0 +1,66 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "fmt"
+
+// BuildConnack constructs the fixed header and CONNACK variable header bytes
+// for version, carrying either the MQTT 3.1/3.1.1 return code (via
+// ReasonCode.V3ReturnCode) or the MQTT 5.0 reason code directly, depending
+// on version. It's the usual companion to NegotiateVersion: call
+// NegotiateVersion first to decide version and code, then BuildConnack to
+// turn that decision into bytes on the wire.
+//
+// This tree doesn't have a dedicated ConnackMessage type yet (only header.go
+// has landed so far), so the caller is responsible for writing the packet:
+// call h.SetProperties first if the CONNACK carries any (V50 only), then
+// h.EncodeMessageTo(w, varHeader), which writes the fixed header, varHeader,
+// and the Properties block in the correct order (ack flags and reason code
+// before Properties) and sizes Remaining Length to cover all three. Plain
+// h.encode writes only the fixed header, and h.EncodeTo would place
+// varHeader after the Properties block, which is backwards from the real
+// CONNACK layout.
+func BuildConnack(version ProtocolVersion, code ReasonCode, sessionPresent bool) (h *header, varHeader []byte, err error) {
+	if !version.Valid() {
+		return nil, nil, fmt.Errorf("message/BuildConnack: Invalid protocol version %d", version)
+	}
+
+	h = &header{}
+
+	if err := h.SetType(CONNACK); err != nil {
+		return nil, nil, err
+	}
+
+	if err := h.SetVersion(version); err != nil {
+		return nil, nil, err
+	}
+
+	var flags byte
+	if sessionPresent {
+		flags = 0x01
+	}
+
+	if version == V50 {
+		varHeader = []byte{flags, byte(code)}
+	} else {
+		varHeader = []byte{flags, byte(code.V3ReturnCode())}
+	}
+
+	if err := h.SetRemainingLength(int32(len(varHeader))); err != nil {
+		return nil, nil, err
+	}
+
+	return h, varHeader, nil
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FixedHeader is the decoded form of a message's fixed header: control
+// packet type, flags, and remaining length. Unlike header, it owns no
+// backing buffer, so it can be produced by reading a handful of bytes off
+// an io.Reader without buffering the rest of the packet.
+type FixedHeader struct {
+	Type   MessageType
+	Flags  byte
+	RemLen int32
+
+	// RemLenBytes is the number of bytes the Remaining Length Variable Byte
+	// Integer actually occupied on the wire. The MQTT spec allows encoding a
+	// value with more bytes than its minimal (canonical) form needs — e.g.
+	// 0x80 0x00 is a legal, if wasteful, 2-byte encoding of 0 — so this can
+	// be larger than varIntLen(RemLen). Callers resuming parsing after the
+	// fixed header must skip this many bytes, not varIntLen(RemLen) worth.
+	RemLenBytes int
+}
+
+// Decoder reads the pieces of an MQTT packet off an io.Reader. It exists so
+// that decoding a message doesn't require the whole packet to already be
+// sitting in a []byte: a PUBLISH payload in particular can be many
+// megabytes, and callers that only want to stream it to disk or to a
+// subscriber socket shouldn't have to buffer it first.
+//
+// Implementations are not required to be safe for concurrent use.
+type Decoder interface {
+	// DecodeHeader reads a fixed header (type, flags, remaining length)
+	// from r.
+	DecodeHeader(r io.Reader) (FixedHeader, error)
+
+	// DecodeVarHeader reads n raw bytes of variable header from r, e.g. a
+	// packet identifier or a CONNECT protocol name/level/flags/keepalive
+	// block.
+	DecodeVarHeader(r io.Reader, n int) ([]byte, error)
+
+	// DecodeString reads an MQTT UTF-8 string (2 byte length prefix
+	// followed by the UTF-8 bytes) from r.
+	DecodeString(r io.Reader) (string, error)
+
+	// DecodeBinary reads an MQTT binary data field (2 byte length prefix
+	// followed by the raw bytes) from r.
+	DecodeBinary(r io.Reader) ([]byte, error)
+}
+
+// allocDecoder is the default Decoder. It allocates a new []byte for every
+// field it reads, which is simple and safe to share across goroutines, but
+// puts pressure on the garbage collector on the hot path. Use pooledDecoder
+// when that matters.
+type allocDecoder struct{}
+
+// NewDecoder returns the default, allocating Decoder implementation.
+func NewDecoder() Decoder {
+	return allocDecoder{}
+}
+
+func (allocDecoder) DecodeHeader(r io.Reader) (FixedHeader, error) {
+	return decodeFixedHeader(r)
+}
+
+func (allocDecoder) DecodeVarHeader(r io.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("decoder/DecodeVarHeader: %s", err)
+	}
+
+	return buf, nil
+}
+
+func (allocDecoder) DecodeString(r io.Reader) (string, error) {
+	b, err := allocDecoder{}.DecodeBinary(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (allocDecoder) DecodeBinary(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, fmt.Errorf("decoder/DecodeBinary: %s", err)
+	}
+
+	l := binary.BigEndian.Uint16(lenBuf[:])
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("decoder/DecodeBinary: %s", err)
+	}
+
+	return buf, nil
+}
+
+// pooledDecoder is a Decoder that reuses a small set of scratch buffers
+// across calls instead of allocating a new []byte for every field. It is
+// not safe for concurrent use; callers that decode on multiple goroutines
+// should use one pooledDecoder per goroutine (or per connection).
+type pooledDecoder struct {
+	varHeader [256]byte
+	str       [256]byte
+}
+
+// NewPooledDecoder returns a Decoder that reuses its scratch buffers across
+// calls, avoiding allocation for fields that fit within them. Fields larger
+// than the scratch buffer fall back to allocating, same as NewDecoder.
+func NewPooledDecoder() Decoder {
+	return &pooledDecoder{}
+}
+
+func (d *pooledDecoder) DecodeHeader(r io.Reader) (FixedHeader, error) {
+	return decodeFixedHeader(r)
+}
+
+func (d *pooledDecoder) DecodeVarHeader(r io.Reader, n int) ([]byte, error) {
+	if n > len(d.varHeader) {
+		return allocDecoder{}.DecodeVarHeader(r, n)
+	}
+
+	buf := d.varHeader[:n]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("decoder/DecodeVarHeader: %s", err)
+	}
+
+	return buf, nil
+}
+
+func (d *pooledDecoder) DecodeString(r io.Reader) (string, error) {
+	b, err := d.decodeBinary(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func (d *pooledDecoder) DecodeBinary(r io.Reader) ([]byte, error) {
+	return d.decodeBinary(r)
+}
+
+func (d *pooledDecoder) decodeBinary(r io.Reader) ([]byte, error) {
+	var lenBuf [2]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, fmt.Errorf("decoder/DecodeBinary: %s", err)
+	}
+
+	l := int(binary.BigEndian.Uint16(lenBuf[:]))
+	if l > len(d.str) {
+		buf := make([]byte, l)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("decoder/DecodeBinary: %s", err)
+		}
+		return buf, nil
+	}
+
+	buf := d.str[:l]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("decoder/DecodeBinary: %s", err)
+	}
+
+	return buf, nil
+}
+
+func decodeFixedHeader(r io.Reader) (FixedHeader, error) {
+	var typeFlags [1]byte
+	if _, err := io.ReadFull(r, typeFlags[:]); err != nil {
+		return FixedHeader{}, fmt.Errorf("decoder/DecodeHeader: %s", err)
+	}
+
+	mtype := MessageType(typeFlags[0] >> 4)
+	if !mtype.Valid() {
+		return FixedHeader{}, fmt.Errorf("decoder/DecodeHeader: Invalid message type %d.", mtype)
+	}
+
+	flags := typeFlags[0] & 0x0f
+
+	var remLen uint64
+	var shift uint
+	terminated := false
+	remLenBytes := 0
+	for i := 0; i < 4; i++ {
+		var b [1]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return FixedHeader{}, fmt.Errorf("decoder/DecodeHeader: %s", err)
+		}
+		remLenBytes++
+
+		remLen |= uint64(b[0]&0x7f) << shift
+		if b[0]&0x80 == 0 {
+			terminated = true
+			break
+		}
+		shift += 7
+	}
+
+	// The MQTT spec caps the remaining length varint at 4 bytes. A 4th byte
+	// that still has its continuation bit set is a malformed (or malicious)
+	// encoding: silently accepting it would desync this decoder from the
+	// real remaining-length boundary and misparse everything that follows
+	// on the connection.
+	if !terminated {
+		return FixedHeader{}, fmt.Errorf("decoder/DecodeHeader: Remaining length varint not terminated within 4 bytes")
+	}
+
+	if remLen > maxRemainingLength {
+		return FixedHeader{}, fmt.Errorf("decoder/DecodeHeader: Remaining length (%d) out of bound (max %d)", remLen, maxRemainingLength)
+	}
+
+	return FixedHeader{Type: mtype, Flags: flags, RemLen: int32(remLen), RemLenBytes: remLenBytes}, nil
+}
+
+// PayloadReader returns an io.Reader limited to n bytes, suitable for
+// streaming a PUBLISH payload straight to disk or to a subscriber socket
+// without buffering it in memory first. Callers computing n should use
+// RemainingLength() minus however many bytes of variable header (topic
+// name, packet ID, V50 properties) they've already consumed from r.
+func PayloadReader(r io.Reader, n int64) io.Reader {
+	return io.LimitReader(r, n)
+}
+
+// decodeFrom populates h by reading its fixed header through dec from r. It
+// is the io.Reader-based counterpart to decode([]byte); decode itself is now
+// implemented in terms of it, via a bytes.Reader, so there is a single
+// source of truth for the wire format.
+func (h *header) decodeFrom(dec Decoder, r io.Reader) (int, error) {
+	fh, err := dec.DecodeHeader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 1
+
+	h.mTypeFlagsBuf[0] = byte(fh.Type)<<4 | fh.Flags
+	h.mTypeFlags = h.mTypeFlagsBuf[:]
+	h.dirty = true
+
+	if fh.Type != PUBLISH && fh.Flags != fh.Type.DefaultFlags() {
+		return total, fmt.Errorf("header/Decode: Invalid message (%d) flags. Expecting %d, got %d", fh.Type, fh.Type.DefaultFlags(), fh.Flags)
+	}
+
+	if fh.Type == PUBLISH && !ValidQos((fh.Flags>>1)&0x3) {
+		return total, fmt.Errorf("header/Decode: Invalid QoS (%d) for PUBLISH message.", (fh.Flags>>1)&0x3)
+	}
+
+	h.remLen = fh.RemLen
+	// fh.RemLenBytes, not varIntLen(fh.RemLen): the encoding on the wire may
+	// not be canonical (minimal-length), and total must reflect the bytes
+	// actually consumed from r so callers resuming parsing after the fixed
+	// header don't desync.
+	total += fh.RemLenBytes
+
+	return total, nil
+}
+
+// decode reads a complete fixed header from src. It is kept for backward
+// compatibility with callers that already have the whole packet buffered;
+// internally it now just drives decodeFrom over a bytes.Reader.
+func (h *header) decode(src []byte) (int, error) {
+	h.dBuf = src
+
+	r := bytes.NewReader(src)
+
+	n, err := h.decodeFrom(NewDecoder(), r)
+	if err != nil {
+		metrics.DecodeError(h.Type(), decodeErrorReason(err))
+		metrics.DecodedMessage(h.Type(), h.Version(), "error")
+		return n, err
+	}
+
+	if int(h.remLen) > r.Len() {
+		metrics.DecodeError(h.Type(), "remaining_length")
+		metrics.DecodedMessage(h.Type(), h.Version(), "error")
+		return n, fmt.Errorf("header/Decode: Remaining length (%d) is greater than remaining buffer (%d)", h.remLen, r.Len())
+	}
+
+	metrics.DecodedMessage(h.Type(), h.Version(), "ok")
+	metrics.MessageBytes("in", h.Type(), n+int(h.remLen))
+
+	return n, nil
+}
+
+// decodeErrorReason maps a decode error to the short, stable tag Recorder
+// implementations key their error counters on.
+func decodeErrorReason(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case containsAny(err.Error(), "Invalid message type"):
+		return "invalid_type"
+	case containsAny(err.Error(), "Invalid message", "flags"):
+		return "invalid_flags"
+	case containsAny(err.Error(), "Invalid QoS"):
+		return "invalid_qos"
+	case containsAny(err.Error(), "Remaining length", "remaining buffer"):
+		return "remaining_length"
+	case containsAny(err.Error(), "EOF", "unexpected EOF"):
+		return "buffer_underrun"
+	default:
+		return "unknown"
+	}
+}
+
+func containsAny(s string, substrs ...string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestDecodeFixedHeaderNonMinimalRemainingLength checks that a Remaining
+// Length encoded with more bytes than its canonical (minimal) form needs is
+// still accepted, and that the bytes actually consumed are reported as such
+// rather than recomputed from the decoded value — which would desync a
+// caller resuming parsing right after the fixed header.
+func TestDecodeFixedHeaderNonMinimalRemainingLength(t *testing.T) {
+	// PINGREQ, Remaining Length 0 encoded non-minimally as two bytes
+	// (0x80, 0x00) instead of the canonical single 0x00.
+	src := []byte{byte(PINGREQ) << 4, 0x80, 0x00}
+
+	fh, err := decodeFixedHeader(bytes.NewReader(src))
+	if err != nil {
+		t.Fatalf("decodeFixedHeader rejected a non-minimal but valid Remaining Length encoding: %s", err)
+	}
+
+	if fh.RemLen != 0 {
+		t.Fatalf("RemLen = %d, want 0", fh.RemLen)
+	}
+
+	if fh.RemLenBytes != 2 {
+		t.Fatalf("RemLenBytes = %d, want 2 (the non-canonical encoding actually used)", fh.RemLenBytes)
+	}
+
+	if varIntLen(uint32(fh.RemLen)) == fh.RemLenBytes {
+		t.Fatalf("test is no longer exercising a non-minimal encoding: varIntLen(%d) = %d matches RemLenBytes", fh.RemLen, fh.RemLenBytes)
+	}
+
+	h := &header{}
+	n, err := h.decode(append(append([]byte(nil), src...)))
+	if err != nil {
+		t.Fatalf("header.decode rejected a non-minimal but valid Remaining Length encoding: %s", err)
+	}
+
+	if n != len(src) {
+		t.Fatalf("decode reported %d bytes consumed, want %d (the actual non-canonical encoding length, not varIntLen(RemLen))", n, len(src))
+	}
+}
@@ -17,6 +17,7 @@ package message
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 )
 
 var (
@@ -35,6 +36,13 @@ type header struct {
 	// mTypeFlags is the first byte of the buffer, 4 bits for mType, 4 bits for flags
 	mTypeFlags []byte
 
+	// mTypeFlagsBuf backs mTypeFlags for decodeFrom (and so for decode,
+	// which drives it), since reading from an io.Reader leaves no source
+	// []byte to sub-slice into. Reusing this inline array
+	// across repeated decodes on the same header avoids allocating a new
+	// one-byte slice on every call.
+	mTypeFlagsBuf [1]byte
+
 	// Some messages need packet ID, 2 byte uint16
 	packetID []byte
 
@@ -43,6 +51,20 @@ type header struct {
 
 	// Whether the message has changed since last decode
 	dirty bool
+
+	// version is the MQTT protocol version this header was (or should be)
+	// encoded with. It defaults to V311 so existing V3.1.1 callers keep
+	// their current wire format without having to call SetVersion.
+	version ProtocolVersion
+
+	// props is the MQTT 5.0 Properties block for this message. It is nil
+	// for V3.1/V3.1.1 messages, and for V5 messages that don't carry any
+	// properties.
+	props *Properties
+
+	// scratch is pooled scratch space obtained from getBuffer for encoding.
+	// It is returned to the pool by Release.
+	scratch []byte
 }
 
 // String returns a string representation of the message.
@@ -127,6 +149,75 @@ func (h *header) Len() int {
 	return h.msgLen()
 }
 
+// Version returns the MQTT protocol version this header was decoded with, or
+// that it will be encoded with. It defaults to V311.
+func (h *header) Version() ProtocolVersion {
+	if h.version == 0 {
+		return V311
+	}
+
+	return h.version
+}
+
+// SetVersion sets the MQTT protocol version to encode/decode this header
+// with. It returns an error if the version is not one this package supports.
+func (h *header) SetVersion(v ProtocolVersion) error {
+	if !v.Valid() {
+		return fmt.Errorf("header/SetVersion: Invalid protocol version %d", v)
+	}
+
+	h.version = v
+	h.dirty = true
+
+	return nil
+}
+
+// Properties returns the MQTT 5.0 Properties block for this message, or nil
+// if the message has no properties (either because it's a V3.1/V3.1.1
+// message, or because none were set).
+func (h *header) Properties() *Properties {
+	return h.props
+}
+
+// SetProperties sets the MQTT 5.0 Properties block for this message. It is
+// only meaningful for V50 messages; it is ignored on encode for earlier
+// protocol versions.
+func (h *header) SetProperties(p *Properties) {
+	h.props = p
+	h.dirty = true
+}
+
+// encodeProperties writes the Properties block to dst if this header is
+// V50, and is a no-op for earlier protocol versions. EncodeMessageTo calls
+// this after writing the message's own variable header, since the
+// Properties block follows the variable header and is covered by the same
+// remaining length as the rest of the message; EncodeTo calls it directly
+// after the fixed header.
+func (h *header) encodeProperties(dst []byte) (int, error) {
+	if !h.Version().HasProperties() {
+		return 0, nil
+	}
+
+	return h.props.encode(dst)
+}
+
+// decodeProperties reads the Properties block from src if this header is
+// V50, and is a no-op for earlier protocol versions.
+func (h *header) decodeProperties(src []byte) (int, error) {
+	if !h.Version().HasProperties() {
+		return 0, nil
+	}
+
+	p, n, err := decodeProperties(src)
+	if err != nil {
+		return n, err
+	}
+
+	h.props = p
+
+	return n, nil
+}
+
 // PacketId returns the ID of the packet.
 func (h *header) PacketId() uint16 {
 	if len(h.packetID) == 2 {
@@ -155,6 +246,9 @@ func (h *header) SetPacketId(v uint16) {
 	// slice. If that's the case, then during encoding we would have copied the whole
 	// backing buffer anyway.
 	binary.BigEndian.PutUint16(h.packetID, v)
+
+	gPacketId++
+	metrics.PacketIDsAssigned(gPacketId)
 }
 
 func (h *header) encode(dst []byte) (int, error) {
@@ -174,60 +268,136 @@ func (h *header) encode(dst []byte) (int, error) {
 		return total, fmt.Errorf("header/Encode: Invalid message type %d", h.Type())
 	}
 
+	// A CONNECT built fresh to send (never decoded) must have its version
+	// set explicitly, since that's what picks the wire format (in
+	// particular, whether a Properties block follows). A CONNECT that was
+	// itself decoded off the wire is exempt: decodeWithContext sets
+	// h.version already when the protocol level was available, and when
+	// it wasn't (plain decode, no DecoderContext) Version() defaulting to
+	// V311 is exactly the "unchanged round trip" chunk0-1 asks for.
+	if h.Type() == CONNECT && h.version == 0 && h.dBuf == nil {
+		return total, fmt.Errorf("header/Encode: protocol version must be set (call SetVersion) before encoding CONNECT")
+	}
+
 	dst[total] = h.mTypeFlags[0]
 	total += 1
 
 	n := binary.PutUvarint(dst[total:], uint64(h.remLen))
 	total += n
 
+	metrics.EncodedMessage(h.Type(), h.Version())
+	metrics.MessageBytes("out", h.Type(), total+int(h.remLen))
+
 	return total, nil
 }
 
-// Decode reads from the io.Reader parameter until a full message is decoded, or
-// when io.Reader returns EOF or error. The first return value is the number of
-// bytes read from io.Reader. The second is error if Decode encounters any problems.
-func (h *header) decode(src []byte) (int, error) {
-	total := 0
+// EncodeTo writes the fixed header (and, for V50, the Properties block)
+// directly to w using pooled scratch space, rather than requiring the
+// caller to size and own a []byte. It returns the number of bytes written.
+//
+// EncodeTo writes no variable header and no payload, and leaves Remaining
+// Length as the caller set it. For V50 the Properties block directly
+// follows the fixed header, so a message with its own variable header is
+// written with EncodeMessageTo instead. No message type in this package
+// streams a payload through EncodeTo.
+func (h *header) EncodeTo(w io.Writer) (int, error) {
+	hl := h.msgLen()
+	pl := 0
+	if h.Version().HasProperties() {
+		pl = h.props.Len()
+		pl += varIntLen(uint32(pl))
+	}
 
-	h.dBuf = src
+	if cap(h.scratch) < hl+pl {
+		if h.scratch != nil {
+			putBuffer(h.scratch)
+		}
+		h.scratch = getBuffer(hl + pl)
+	}
+	buf := h.scratch[:hl+pl]
 
-	mType := h.Type()
-	//mType := MessageType(0)
+	n, err := h.encode(buf[:hl])
+	if err != nil {
+		return 0, err
+	}
 
-	h.mTypeFlags = src[total : total+1]
-	//mType := MessageType(src[total] >> 4)
-	if !h.Type().Valid() {
-		return total, fmt.Errorf("header/Decode: Invalid message type %d.", mType)
+	if pl > 0 {
+		pn, err := h.encodeProperties(buf[hl:])
+		if err != nil {
+			return 0, err
+		}
+		n += pn
+	}
+
+	written, err := w.Write(buf[:n])
+	if err != nil {
+		return written, fmt.Errorf("header/EncodeTo: %s", err)
 	}
 
-	if mType != h.Type() {
-		return total, fmt.Errorf("header/Decode: Invalid message type %d. Expecting %d.", h.Type(), mType)
+	return written, nil
+}
+
+// EncodeMessageTo writes the fixed header, followed by varHeader, followed
+// by the V50 Properties block (if any), to w, and updates the fixed
+// header's Remaining Length to cover all three. It exists because the
+// Properties block always follows a message's own variable header (e.g. a
+// CONNACK's ack flags and reason code, or a PUBLISH's topic name and packet
+// ID), never the fixed header directly: EncodeTo can't be used for these,
+// since it writes Properties immediately after the fixed header and would
+// leave varHeader stranded after them.
+func (h *header) EncodeMessageTo(w io.Writer, varHeader []byte) (int, error) {
+	pl := 0
+	if h.Version().HasProperties() {
+		pl = h.props.Len()
+		pl += varIntLen(uint32(pl))
 	}
 
-	//this.flags = src[total] & 0x0f
-	if h.Type() != PUBLISH && h.Flags() != h.Type().DefaultFlags() {
-		return total, fmt.Errorf("header/Decode: Invalid message (%d) flags. Expecting %d, got %d", h.Type(), h.Type().DefaultFlags(), h.Flags())
+	if err := h.SetRemainingLength(int32(len(varHeader) + pl)); err != nil {
+		return 0, err
 	}
 
-	if h.Type() == PUBLISH && !ValidQos((h.Flags()>>1)&0x3) {
-		return total, fmt.Errorf("header/Decode: Invalid QoS (%d) for PUBLISH message.", (h.Flags()>>1)&0x3)
+	hl := h.msgLen()
+	total := hl + len(varHeader) + pl
+
+	if cap(h.scratch) < total {
+		if h.scratch != nil {
+			putBuffer(h.scratch)
+		}
+		h.scratch = getBuffer(total)
 	}
+	buf := h.scratch[:total]
 
-	total++
+	n, err := h.encode(buf[:hl])
+	if err != nil {
+		return 0, err
+	}
 
-	remLen, m := binary.Uvarint(src[total:])
-	total += m
-	h.remLen = int32(remLen)
+	n += copy(buf[n:], varHeader)
 
-	if h.remLen > maxRemainingLength || remLen < 0 {
-		return total, fmt.Errorf("header/Decode: Remaining length (%d) out of bound (max %d, min 0)", h.remLen, maxRemainingLength)
+	if pl > 0 {
+		pn, err := h.encodeProperties(buf[n:])
+		if err != nil {
+			return 0, err
+		}
+		n += pn
 	}
 
-	if int(h.remLen) > len(src[total:]) {
-		return total, fmt.Errorf("header/Decode: Remaining length (%d) is greater than remaining buffer (%d)", h.remLen, len(src[total:]))
+	written, err := w.Write(buf[:n])
+	if err != nil {
+		return written, fmt.Errorf("header/EncodeMessageTo: %s", err)
 	}
 
-	return total, nil
+	return written, nil
+}
+
+// Release returns this header's pooled scratch buffers to the pool. Callers
+// (typically a broker, once a QoS0 PUBLISH has been delivered or a QoS1/2
+// ack is complete) must not use the message again after calling Release.
+func (h *header) Release() {
+	if h.scratch != nil {
+		putBuffer(h.scratch)
+		h.scratch = nil
+	}
 }
 
 func (h *header) msgLen() int {
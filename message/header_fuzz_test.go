@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "testing"
+
+// FuzzHeaderDecode feeds arbitrary bytes to header.decode looking for panics
+// and out-of-bounds reads, and checks that any header that does decode
+// successfully round-trips through encode/decode unchanged.
+//
+// NOTE: FuzzConnectMessage, FuzzPublishMessage, FuzzSubscribeMessage and
+// FuzzSubackMessage from the original request are not included here: this
+// tree does not yet have connect.go/publish.go/subscribe.go/suback.go (only
+// header.go has landed so far), so there is no concrete decoder to fuzz.
+// Add them alongside those message types when they're implemented.
+func FuzzHeaderDecode(f *testing.F) {
+	f.Add([]byte{byte(PUBLISH)<<4 | 0x02, 0x00})
+	f.Add([]byte{byte(PUBLISH)<<4 | 0x02, 0x7f})
+	f.Add([]byte{byte(PINGREQ) << 4, 0x00})
+	f.Add([]byte{})
+	f.Add([]byte{byte(PUBLISH) << 4})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff})
+	// A valid type byte followed by 4 remaining-length bytes that all keep
+	// the continuation bit (0x80) set: the varint never terminates, and
+	// must be rejected rather than silently truncated to 28 bits.
+	f.Add([]byte{byte(PINGREQ) << 4, 0xff, 0xff, 0xff, 0xff})
+	// A remaining length of 0 encoded non-minimally as two bytes (0x80,
+	// 0x00) instead of the canonical single 0x00. See
+	// TestDecodeFixedHeaderNonMinimalRemainingLength (decoder_test.go) for
+	// the assertion this case actually needs: that the reported consumed
+	// byte count matches the non-canonical encoding, not varIntLen(RemLen).
+	f.Add([]byte{byte(PINGREQ) << 4, 0x80, 0x00})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := &header{}
+
+		n, err := h.decode(data)
+		if err != nil {
+			return
+		}
+
+		if n < 2 || n > len(data) {
+			t.Fatalf("decode reported %d bytes consumed from a %d byte buffer", n, len(data))
+		}
+
+		gotType, gotFlags, gotRemLen := h.Type(), h.Flags(), h.RemainingLength()
+
+		// decode only ever inspects the fixed header, but it also checks
+		// that remLen bytes of "payload" actually follow it, so the
+		// re-encoded buffer needs that many trailing bytes to decode again
+		// even though their content is irrelevant to this test.
+		buf := make([]byte, h.Len()+int(gotRemLen))
+		if _, err := h.encode(buf); err != nil {
+			t.Fatalf("encode of a successfully decoded header failed: %s", err)
+		}
+
+		h2 := &header{}
+		if _, err := h2.decode(buf); err != nil {
+			t.Fatalf("re-decode of a re-encoded header failed: %s", err)
+		}
+
+		if h2.Type() != gotType || h2.Flags() != gotFlags || h2.RemainingLength() != gotRemLen {
+			t.Fatalf("decode . encode . decode not idempotent: got (%q,%08b,%d), want (%q,%08b,%d)",
+				h2.Type().Name(), h2.Flags(), h2.RemainingLength(), gotType.Name(), gotFlags, gotRemLen)
+		}
+	})
+}
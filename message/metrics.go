@@ -0,0 +1,70 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+// Recorder receives observability events from the encode/decode hot path.
+// It is defined here, rather than depending on a metrics client directly,
+// so that this package has no hard dependency on Prometheus (or anything
+// else) by default. See package message/metrics for a ready-made Recorder
+// backed by the Prometheus client.
+type Recorder interface {
+	// DecodedMessage is called once per header.decode, whether it succeeds
+	// or fails. result is "ok" or "error".
+	DecodedMessage(mtype MessageType, version ProtocolVersion, result string)
+
+	// EncodedMessage is called once per header.encode/EncodeTo.
+	EncodedMessage(mtype MessageType, version ProtocolVersion)
+
+	// MessageBytes reports the on-the-wire size (remaining length plus the
+	// fixed header) of a decoded or encoded message. direction is "in" or
+	// "out".
+	MessageBytes(direction string, mtype MessageType, n int)
+
+	// DecodeError is called whenever header.decode rejects a message.
+	// reason is a short, stable, low-cardinality tag such as
+	// "invalid_type", "invalid_flags", "invalid_qos", "remaining_length",
+	// or "buffer_underrun".
+	DecodeError(mtype MessageType, reason string)
+
+	// PacketIDsAssigned reports the current value of the module-level
+	// packet ID counter: the total number of packet IDs SetPacketId has
+	// assigned since the process started. It is monotonically increasing,
+	// not a gauge of packet IDs currently in flight — this package has no
+	// visibility into when a packet ID's ack completes, so it can't track
+	// that.
+	PacketIDsAssigned(n uint64)
+}
+
+// noopRecorder is the default Recorder: every method is a no-op, so calling
+// SetMetrics is entirely optional and costs nothing if skipped.
+type noopRecorder struct{}
+
+func (noopRecorder) DecodedMessage(MessageType, ProtocolVersion, string) {}
+func (noopRecorder) EncodedMessage(MessageType, ProtocolVersion)         {}
+func (noopRecorder) MessageBytes(string, MessageType, int)               {}
+func (noopRecorder) DecodeError(MessageType, string)                     {}
+func (noopRecorder) PacketIDsAssigned(uint64)                            {}
+
+var metrics Recorder = noopRecorder{}
+
+// SetMetrics installs r as the package-wide Recorder for encode/decode
+// events. Passing nil restores the default no-op Recorder.
+func SetMetrics(r Recorder) {
+	if r == nil {
+		r = noopRecorder{}
+	}
+
+	metrics = r
+}
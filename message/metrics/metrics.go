@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics provides a Prometheus-backed message.Recorder, giving
+// brokers built on this module message-layer observability without having
+// to instrument the wire layer themselves.
+//
+// Installing it is opt-in:
+//
+//	rec := metrics.NewRecorder(prometheus.DefaultRegisterer)
+//	message.SetMetrics(rec)
+//
+// The core message package has no dependency on this package, or on the
+// Prometheus client, unless SetMetrics is called.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/surgemq/surgemq/message"
+)
+
+// Recorder implements message.Recorder on top of the Prometheus client.
+type Recorder struct {
+	decoded           *prometheus.CounterVec
+	encoded           *prometheus.CounterVec
+	bytes             *prometheus.HistogramVec
+	decodeErrors      *prometheus.CounterVec
+	packetIDsAssigned prometheus.Counter
+	lastPacketIDs     uint64
+}
+
+// NewRecorder creates a Recorder and registers its collectors with reg. Pass
+// prometheus.DefaultRegisterer to use the global registry.
+func NewRecorder(reg prometheus.Registerer) *Recorder {
+	r := &Recorder{
+		decoded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_messages_decoded_total",
+			Help: "Total number of MQTT messages decoded, by type, protocol version and result.",
+		}, []string{"type", "version", "result"}),
+
+		encoded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_messages_encoded_total",
+			Help: "Total number of MQTT messages encoded, by type and protocol version.",
+		}, []string{"type", "version"}),
+
+		bytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mqtt_message_bytes",
+			Help:    "Size in bytes of encoded/decoded MQTT messages, by direction and type.",
+			Buckets: prometheus.ExponentialBuckets(16, 4, 10),
+		}, []string{"direction", "type"}),
+
+		decodeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_decode_errors_total",
+			Help: "Total number of MQTT decode errors, by type and reason.",
+		}, []string{"type", "reason"}),
+
+		packetIDsAssigned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_packet_ids_assigned_total",
+			Help: "Total number of MQTT packet IDs assigned by SetPacketId since the process started. Monotonically increasing, not a count of packet IDs currently in flight.",
+		}),
+	}
+
+	reg.MustRegister(r.decoded, r.encoded, r.bytes, r.decodeErrors, r.packetIDsAssigned)
+
+	return r
+}
+
+func (r *Recorder) DecodedMessage(mtype message.MessageType, version message.ProtocolVersion, result string) {
+	r.decoded.WithLabelValues(mtype.Name(), version.String(), result).Inc()
+}
+
+func (r *Recorder) EncodedMessage(mtype message.MessageType, version message.ProtocolVersion) {
+	r.encoded.WithLabelValues(mtype.Name(), version.String()).Inc()
+}
+
+func (r *Recorder) MessageBytes(direction string, mtype message.MessageType, n int) {
+	r.bytes.WithLabelValues(direction, mtype.Name()).Observe(float64(n))
+}
+
+func (r *Recorder) DecodeError(mtype message.MessageType, reason string) {
+	r.decodeErrors.WithLabelValues(mtype.Name(), reason).Inc()
+}
+
+func (r *Recorder) PacketIDsAssigned(n uint64) {
+	if n > r.lastPacketIDs {
+		r.packetIDsAssigned.Add(float64(n - r.lastPacketIDs))
+		r.lastPacketIDs = n
+	}
+}
+
+var _ message.Recorder = (*Recorder)(nil)
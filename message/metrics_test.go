@@ -0,0 +1,138 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "testing"
+
+// fakeRecorder is a Recorder that just counts calls, so tests can assert
+// the encode/decode hot path actually drives the hook rather than silently
+// no-op'ing.
+type fakeRecorder struct {
+	decoded      int
+	decodedError int
+	encoded      int
+	bytesIn      int
+	bytesOut     int
+	decodeErrors map[string]int
+	assigned     uint64
+}
+
+func newFakeRecorder() *fakeRecorder {
+	return &fakeRecorder{decodeErrors: map[string]int{}}
+}
+
+func (f *fakeRecorder) DecodedMessage(mtype MessageType, version ProtocolVersion, result string) {
+	f.decoded++
+	if result != "ok" {
+		f.decodedError++
+	}
+}
+
+func (f *fakeRecorder) EncodedMessage(mtype MessageType, version ProtocolVersion) {
+	f.encoded++
+}
+
+func (f *fakeRecorder) MessageBytes(direction string, mtype MessageType, n int) {
+	if direction == "in" {
+		f.bytesIn++
+	} else {
+		f.bytesOut++
+	}
+}
+
+func (f *fakeRecorder) DecodeError(mtype MessageType, reason string) {
+	f.decodeErrors[reason]++
+}
+
+func (f *fakeRecorder) PacketIDsAssigned(n uint64) {
+	f.assigned = n
+}
+
+// TestMetricsHooksFire installs a fakeRecorder and checks that a normal
+// encode/decode round trip, a rejected decode, and SetPacketId all reach it.
+func TestMetricsHooksFire(t *testing.T) {
+	rec := newFakeRecorder()
+	SetMetrics(rec)
+	defer SetMetrics(nil)
+
+	h := &header{}
+	if err := h.SetType(PUBLISH); err != nil {
+		t.Fatalf("SetType: %s", err)
+	}
+	if err := h.SetRemainingLength(4); err != nil {
+		t.Fatalf("SetRemainingLength: %s", err)
+	}
+
+	buf := make([]byte, h.Len())
+	if _, err := h.encode(buf); err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+
+	if rec.encoded != 1 {
+		t.Fatalf("encoded = %d, want 1", rec.encoded)
+	}
+	if rec.bytesOut != 1 {
+		t.Fatalf("bytesOut = %d, want 1", rec.bytesOut)
+	}
+
+	h2 := &header{}
+	payload := append(append([]byte(nil), buf...), 0, 0, 0, 0)
+	if _, err := h2.decode(payload); err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+
+	if rec.decoded != 1 {
+		t.Fatalf("decoded = %d, want 1", rec.decoded)
+	}
+	if rec.bytesIn != 1 {
+		t.Fatalf("bytesIn = %d, want 1", rec.bytesIn)
+	}
+
+	if _, err := h2.decode(nil); err == nil {
+		t.Fatal("decode(nil) unexpectedly succeeded")
+	}
+
+	if rec.decoded != 2 || rec.decodedError != 1 {
+		t.Fatalf("decoded=%d decodedError=%d, want 2/1", rec.decoded, rec.decodedError)
+	}
+	if len(rec.decodeErrors) == 0 {
+		t.Fatal("DecodeError was never called for a failed decode")
+	}
+
+	before := gPacketId
+	h2.SetPacketId(42)
+	if rec.assigned != before+1 {
+		t.Fatalf("assigned = %d, want %d", rec.assigned, before+1)
+	}
+}
+
+// TestNoopRecorderIsDefault checks that SetMetrics(nil) restores the no-op
+// Recorder rather than leaving the package without one.
+func TestNoopRecorderIsDefault(t *testing.T) {
+	SetMetrics(nil)
+
+	h := &header{}
+	if err := h.SetType(PUBLISH); err != nil {
+		t.Fatalf("SetType: %s", err)
+	}
+	if err := h.SetRemainingLength(0); err != nil {
+		t.Fatalf("SetRemainingLength: %s", err)
+	}
+
+	buf := make([]byte, h.Len())
+	if _, err := h.encode(buf); err != nil {
+		t.Fatalf("encode with the default Recorder installed failed: %s", err)
+	}
+}
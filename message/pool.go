@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import "sync"
+
+// bufClasses are the size classes the pool hands out, smallest first. A
+// request for n bytes gets the smallest class that still fits n; requests
+// larger than the biggest class allocate directly and are never pooled.
+var bufClasses = [...]int{512, 2048, 8192, 32768}
+
+var bufPools = [len(bufClasses)]sync.Pool{}
+
+func init() {
+	for i, size := range bufClasses {
+		size := size
+		bufPools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+// getBuffer returns a []byte of at least n bytes, from the pool when n fits
+// one of bufClasses, or freshly allocated otherwise. The returned slice has
+// len == n; cap may be larger. Pair with putBuffer to return it once the
+// caller is done (e.g. from Message.Release).
+func getBuffer(n int) []byte {
+	for i, size := range bufClasses {
+		if n <= size {
+			bp := bufPools[i].Get().(*[]byte)
+			return (*bp)[:n]
+		}
+	}
+
+	return make([]byte, n)
+}
+
+// putBuffer returns b to the pool it came from, if any. Buffers not
+// originally obtained from getBuffer (or whose capacity doesn't match a
+// size class exactly) are silently dropped rather than pooled.
+func putBuffer(b []byte) {
+	c := cap(b)
+
+	for i, size := range bufClasses {
+		if c == size {
+			full := b[:size]
+			bufPools[i].Put(&full)
+			return
+		}
+	}
+}
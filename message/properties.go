@@ -0,0 +1,523 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// PropertyIdentifier is the single-byte (encoded as a Variable Byte Integer,
+// but always < 128 for the properties defined by MQTT 5.0) identifier that
+// precedes each value in a Properties block.
+type PropertyIdentifier byte
+
+const (
+	PropertyPayloadFormatIndicator          PropertyIdentifier = 1
+	PropertyMessageExpiryInterval           PropertyIdentifier = 2
+	PropertyContentType                     PropertyIdentifier = 3
+	PropertyResponseTopic                   PropertyIdentifier = 8
+	PropertyCorrelationData                 PropertyIdentifier = 9
+	PropertySubscriptionIdentifier          PropertyIdentifier = 11
+	PropertySessionExpiryInterval           PropertyIdentifier = 17
+	PropertyAssignedClientIdentifier        PropertyIdentifier = 18
+	PropertyServerKeepAlive                 PropertyIdentifier = 19
+	PropertyAuthenticationMethod            PropertyIdentifier = 21
+	PropertyAuthenticationData              PropertyIdentifier = 22
+	PropertyRequestProblemInformation       PropertyIdentifier = 23
+	PropertyWillDelayInterval               PropertyIdentifier = 24
+	PropertyRequestResponseInformation      PropertyIdentifier = 25
+	PropertyResponseInformation             PropertyIdentifier = 26
+	PropertyServerReference                 PropertyIdentifier = 28
+	PropertyReasonString                    PropertyIdentifier = 31
+	PropertyReceiveMaximum                  PropertyIdentifier = 33
+	PropertyTopicAliasMaximum               PropertyIdentifier = 34
+	PropertyTopicAlias                      PropertyIdentifier = 35
+	PropertyMaximumQoS                      PropertyIdentifier = 36
+	PropertyRetainAvailable                 PropertyIdentifier = 37
+	PropertyUserProperty                    PropertyIdentifier = 38
+	PropertyMaximumPacketSize               PropertyIdentifier = 39
+	PropertyWildcardSubscriptionAvailable   PropertyIdentifier = 40
+	PropertySubscriptionIdentifierAvailable PropertyIdentifier = 41
+	PropertySharedSubscriptionAvailable     PropertyIdentifier = 42
+)
+
+// propertyKind describes the on-the-wire shape of a property's value, so
+// that decodeProperties can skip over (and losslessly preserve in
+// Properties.Unknown) any identifier this file doesn't give a dedicated
+// struct field to, without having to special-case every one of the ~25
+// identifiers MQTT 5.0 defines.
+type propertyKind int
+
+const (
+	kindByte propertyKind = iota
+	kindTwoByteInt
+	kindFourByteInt
+	kindVarInt
+	kindUTF8String
+	kindBinaryData
+	kindUTF8StringPair
+)
+
+// propertyKinds maps every property identifier defined by the MQTT 5.0 spec
+// to the shape of its value. An identifier missing from this table is not
+// just unmodeled but unrecognized, and decodeProperties rejects it, since
+// without a width there is no safe way to skip over its value and keep
+// parsing the rest of the block.
+var propertyKinds = map[PropertyIdentifier]propertyKind{
+	PropertyPayloadFormatIndicator:          kindByte,
+	PropertyMessageExpiryInterval:           kindFourByteInt,
+	PropertyContentType:                     kindUTF8String,
+	PropertyResponseTopic:                   kindUTF8String,
+	PropertyCorrelationData:                 kindBinaryData,
+	PropertySubscriptionIdentifier:          kindVarInt,
+	PropertySessionExpiryInterval:           kindFourByteInt,
+	PropertyAssignedClientIdentifier:        kindUTF8String,
+	PropertyServerKeepAlive:                 kindTwoByteInt,
+	PropertyAuthenticationMethod:            kindUTF8String,
+	PropertyAuthenticationData:              kindBinaryData,
+	PropertyRequestProblemInformation:       kindByte,
+	PropertyWillDelayInterval:               kindFourByteInt,
+	PropertyRequestResponseInformation:      kindByte,
+	PropertyResponseInformation:             kindUTF8String,
+	PropertyServerReference:                 kindUTF8String,
+	PropertyReasonString:                    kindUTF8String,
+	PropertyReceiveMaximum:                  kindTwoByteInt,
+	PropertyTopicAliasMaximum:               kindTwoByteInt,
+	PropertyTopicAlias:                      kindTwoByteInt,
+	PropertyMaximumQoS:                      kindByte,
+	PropertyRetainAvailable:                 kindByte,
+	PropertyUserProperty:                    kindUTF8StringPair,
+	PropertyMaximumPacketSize:               kindFourByteInt,
+	PropertyWildcardSubscriptionAvailable:   kindByte,
+	PropertySubscriptionIdentifierAvailable: kindByte,
+	PropertySharedSubscriptionAvailable:     kindByte,
+}
+
+// UserProperty is a single MQTT 5.0 User Property, a free-form UTF-8 key/value
+// pair. Unlike every other property, it may appear more than once in the
+// same Properties block.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// Properties holds the MQTT 5.0 Properties block that follows the variable
+// header of most MQTT 5.0 packets. It is nil for a V3.1/V3.1.1 message, since
+// those versions of the protocol have no notion of properties.
+//
+// decodeProperties understands the wire shape of every identifier the MQTT
+// 5.0 spec defines (see propertyKinds), so a standard CONNACK, PUBLISH, etc.
+// always decodes successfully. Only the identifiers a V5 client needs most
+// often get a dedicated struct field below; everything else is preserved,
+// byte for byte, in Unknown, so an intermediary can pass it through even
+// though this package doesn't expose it by name.
+type Properties struct {
+	PayloadFormatIndicator *byte
+	MessageExpiryInterval  *uint32
+	ContentType            string
+	ResponseTopic          string
+	CorrelationData        []byte
+	SubscriptionIdentifier *uint32
+	SessionExpiryInterval  *uint32
+	TopicAlias             *uint16
+	UserProperties         []UserProperty
+
+	// Unknown holds the raw encoded identifier+value bytes of any property
+	// this package doesn't model explicitly, in the order they were decoded.
+	Unknown []RawProperty
+}
+
+// RawProperty is the encoded identifier and value of a property this package
+// does not parse into a dedicated field.
+type RawProperty struct {
+	Identifier PropertyIdentifier
+	Value      []byte
+}
+
+// Len returns the number of bytes the Properties block occupies on the wire,
+// not including its own Variable Byte Integer length prefix.
+func (p *Properties) Len() int {
+	if p == nil {
+		return 0
+	}
+
+	total := 0
+
+	if p.PayloadFormatIndicator != nil {
+		total += 1 + 1
+	}
+
+	if p.MessageExpiryInterval != nil {
+		total += 1 + 4
+	}
+
+	if p.ContentType != "" {
+		total += 1 + 2 + len(p.ContentType)
+	}
+
+	if p.ResponseTopic != "" {
+		total += 1 + 2 + len(p.ResponseTopic)
+	}
+
+	if p.CorrelationData != nil {
+		total += 1 + 2 + len(p.CorrelationData)
+	}
+
+	if p.SubscriptionIdentifier != nil {
+		total += 1 + varIntLen(*p.SubscriptionIdentifier)
+	}
+
+	if p.SessionExpiryInterval != nil {
+		total += 1 + 4
+	}
+
+	if p.TopicAlias != nil {
+		total += 1 + 2
+	}
+
+	for _, up := range p.UserProperties {
+		total += 1 + 2 + len(up.Key) + 2 + len(up.Value)
+	}
+
+	for _, raw := range p.Unknown {
+		total += 1 + len(raw.Value)
+	}
+
+	return total
+}
+
+// encode writes the Variable Byte Integer length prefix followed by the
+// property list to dst, and returns the number of bytes written.
+func (p *Properties) encode(dst []byte) (int, error) {
+	plen := p.Len()
+
+	total := binary.PutUvarint(dst, uint64(plen))
+
+	if len(dst) < total+plen {
+		return 0, fmt.Errorf("properties/encode: insufficient buffer size. Expecting %d, got %d.", total+plen, len(dst))
+	}
+
+	if p == nil {
+		return total, nil
+	}
+
+	if p.PayloadFormatIndicator != nil {
+		dst[total] = byte(PropertyPayloadFormatIndicator)
+		total++
+		dst[total] = *p.PayloadFormatIndicator
+		total++
+	}
+
+	if p.MessageExpiryInterval != nil {
+		dst[total] = byte(PropertyMessageExpiryInterval)
+		total++
+		binary.BigEndian.PutUint32(dst[total:], *p.MessageExpiryInterval)
+		total += 4
+	}
+
+	if p.ContentType != "" {
+		total += encodePropString(dst[total:], PropertyContentType, p.ContentType)
+	}
+
+	if p.ResponseTopic != "" {
+		total += encodePropString(dst[total:], PropertyResponseTopic, p.ResponseTopic)
+	}
+
+	if p.CorrelationData != nil {
+		dst[total] = byte(PropertyCorrelationData)
+		total++
+		binary.BigEndian.PutUint16(dst[total:], uint16(len(p.CorrelationData)))
+		total += 2
+		total += copy(dst[total:], p.CorrelationData)
+	}
+
+	if p.SubscriptionIdentifier != nil {
+		dst[total] = byte(PropertySubscriptionIdentifier)
+		total++
+		total += binary.PutUvarint(dst[total:], uint64(*p.SubscriptionIdentifier))
+	}
+
+	if p.SessionExpiryInterval != nil {
+		dst[total] = byte(PropertySessionExpiryInterval)
+		total++
+		binary.BigEndian.PutUint32(dst[total:], *p.SessionExpiryInterval)
+		total += 4
+	}
+
+	if p.TopicAlias != nil {
+		dst[total] = byte(PropertyTopicAlias)
+		total++
+		binary.BigEndian.PutUint16(dst[total:], *p.TopicAlias)
+		total += 2
+	}
+
+	for _, up := range p.UserProperties {
+		dst[total] = byte(PropertyUserProperty)
+		total++
+		total += encodeUTF8(dst[total:], up.Key)
+		total += encodeUTF8(dst[total:], up.Value)
+	}
+
+	for _, raw := range p.Unknown {
+		dst[total] = byte(raw.Identifier)
+		total++
+		total += copy(dst[total:], raw.Value)
+	}
+
+	return total, nil
+}
+
+// decodeProperties reads the Variable Byte Integer length prefix followed by
+// the property list from src, and returns the decoded Properties and the
+// number of bytes consumed.
+func decodeProperties(src []byte) (*Properties, int, error) {
+	total := 0
+
+	plen64, n := binary.Uvarint(src[total:])
+	if n <= 0 {
+		return nil, total, fmt.Errorf("properties/decode: invalid property length varint")
+	}
+	total += n
+	plen := int(plen64)
+
+	if plen > len(src[total:]) {
+		return nil, total, fmt.Errorf("properties/decode: property length (%d) is greater than remaining buffer (%d)", plen, len(src[total:]))
+	}
+
+	p := &Properties{}
+	end := total + plen
+
+	for total < end {
+		id := PropertyIdentifier(src[total])
+		total++
+
+		kind, known := propertyKinds[id]
+		if !known {
+			return nil, total, fmt.Errorf("properties/decode: unrecognized property identifier %d", id)
+		}
+
+		// Properties with a dedicated struct field are parsed into it;
+		// everything else is decoded by kind (so the block can still be
+		// skipped over correctly) and kept verbatim in Unknown.
+		switch id {
+		case PropertyPayloadFormatIndicator:
+			if total+1 > end {
+				return nil, total, fmt.Errorf("properties/decode: buffer underrun reading payload format indicator")
+			}
+			v := src[total]
+			p.PayloadFormatIndicator = &v
+			total++
+			continue
+
+		case PropertyMessageExpiryInterval:
+			if total+4 > end {
+				return nil, total, fmt.Errorf("properties/decode: buffer underrun reading message expiry interval")
+			}
+			v := binary.BigEndian.Uint32(src[total:])
+			p.MessageExpiryInterval = &v
+			total += 4
+			continue
+
+		case PropertyContentType:
+			s, n, err := decodeUTF8(src[total:end])
+			if err != nil {
+				return nil, total, err
+			}
+			p.ContentType = s
+			total += n
+			continue
+
+		case PropertyResponseTopic:
+			s, n, err := decodeUTF8(src[total:end])
+			if err != nil {
+				return nil, total, err
+			}
+			p.ResponseTopic = s
+			total += n
+			continue
+
+		case PropertyCorrelationData:
+			if total+2 > end {
+				return nil, total, fmt.Errorf("properties/decode: buffer underrun reading correlation data length")
+			}
+			l := int(binary.BigEndian.Uint16(src[total:]))
+			total += 2
+			if total+l > end {
+				return nil, total, fmt.Errorf("properties/decode: correlation data length (%d) exceeds property block", l)
+			}
+			p.CorrelationData = append([]byte(nil), src[total:total+l]...)
+			total += l
+			continue
+
+		case PropertySubscriptionIdentifier:
+			v, n := binary.Uvarint(src[total:end])
+			if n <= 0 {
+				return nil, total, fmt.Errorf("properties/decode: invalid subscription identifier varint")
+			}
+			v32 := uint32(v)
+			p.SubscriptionIdentifier = &v32
+			total += n
+			continue
+
+		case PropertySessionExpiryInterval:
+			if total+4 > end {
+				return nil, total, fmt.Errorf("properties/decode: buffer underrun reading session expiry interval")
+			}
+			v := binary.BigEndian.Uint32(src[total:])
+			p.SessionExpiryInterval = &v
+			total += 4
+			continue
+
+		case PropertyTopicAlias:
+			if total+2 > end {
+				return nil, total, fmt.Errorf("properties/decode: buffer underrun reading topic alias")
+			}
+			v := binary.BigEndian.Uint16(src[total:])
+			p.TopicAlias = &v
+			total += 2
+			continue
+
+		case PropertyUserProperty:
+			k, n, err := decodeUTF8(src[total:end])
+			if err != nil {
+				return nil, total, err
+			}
+			total += n
+
+			v, n, err := decodeUTF8(src[total:end])
+			if err != nil {
+				return nil, total, err
+			}
+			total += n
+
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: k, Value: v})
+			continue
+		}
+
+		// No dedicated field for this identifier: decode its value by kind
+		// so we stay in sync with the rest of the block, and keep the raw
+		// bytes so encode can write it back out unchanged.
+		value, n, err := decodePropertyValue(kind, src[total:end])
+		if err != nil {
+			return nil, total, err
+		}
+		total += n
+
+		p.Unknown = append(p.Unknown, RawProperty{Identifier: id, Value: value})
+	}
+
+	return p, total, nil
+}
+
+// decodePropertyValue reads a single property value of the given kind from
+// src (which must already be sliced to the end of the enclosing Properties
+// block) and returns the raw, still-encoded bytes it occupies.
+func decodePropertyValue(kind propertyKind, src []byte) ([]byte, int, error) {
+	switch kind {
+	case kindByte:
+		if len(src) < 1 {
+			return nil, 0, fmt.Errorf("properties/decode: buffer underrun reading 1-byte property value")
+		}
+		return append([]byte(nil), src[:1]...), 1, nil
+
+	case kindTwoByteInt:
+		if len(src) < 2 {
+			return nil, 0, fmt.Errorf("properties/decode: buffer underrun reading 2-byte property value")
+		}
+		return append([]byte(nil), src[:2]...), 2, nil
+
+	case kindFourByteInt:
+		if len(src) < 4 {
+			return nil, 0, fmt.Errorf("properties/decode: buffer underrun reading 4-byte property value")
+		}
+		return append([]byte(nil), src[:4]...), 4, nil
+
+	case kindVarInt:
+		_, n := binary.Uvarint(src)
+		if n <= 0 {
+			return nil, 0, fmt.Errorf("properties/decode: invalid variable byte integer property value")
+		}
+		return append([]byte(nil), src[:n]...), n, nil
+
+	case kindUTF8String:
+		_, n, err := decodeUTF8(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		return append([]byte(nil), src[:n]...), n, nil
+
+	case kindBinaryData:
+		if len(src) < 2 {
+			return nil, 0, fmt.Errorf("properties/decode: buffer underrun reading binary data length")
+		}
+		l := int(binary.BigEndian.Uint16(src))
+		if len(src) < 2+l {
+			return nil, 0, fmt.Errorf("properties/decode: binary data length (%d) exceeds buffer", l)
+		}
+		return append([]byte(nil), src[:2+l]...), 2 + l, nil
+
+	case kindUTF8StringPair:
+		_, n1, err := decodeUTF8(src)
+		if err != nil {
+			return nil, 0, err
+		}
+		_, n2, err := decodeUTF8(src[n1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return append([]byte(nil), src[:n1+n2]...), n1 + n2, nil
+
+	default:
+		return nil, 0, fmt.Errorf("properties/decode: unknown property kind %d", kind)
+	}
+}
+
+func encodePropString(dst []byte, id PropertyIdentifier, s string) int {
+	dst[0] = byte(id)
+	return 1 + encodeUTF8(dst[1:], s)
+}
+
+func encodeUTF8(dst []byte, s string) int {
+	binary.BigEndian.PutUint16(dst, uint16(len(s)))
+	n := copy(dst[2:], s)
+	return 2 + n
+}
+
+func decodeUTF8(src []byte) (string, int, error) {
+	if len(src) < 2 {
+		return "", 0, fmt.Errorf("properties/decode: buffer underrun reading UTF-8 string length")
+	}
+
+	l := int(binary.BigEndian.Uint16(src))
+	if len(src) < 2+l {
+		return "", 0, fmt.Errorf("properties/decode: UTF-8 string length (%d) exceeds buffer", l)
+	}
+
+	return string(src[2 : 2+l]), 2 + l, nil
+}
+
+func varIntLen(v uint32) int {
+	switch {
+	case v <= 0x7f:
+		return 1
+	case v <= 0x3fff:
+		return 2
+	case v <= 0x1fffff:
+		return 3
+	default:
+		return 4
+	}
+}
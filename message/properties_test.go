@@ -0,0 +1,183 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// rawConnackProperties builds the Properties portion (length-prefixed) of a
+// realistic MQTT 5.0 CONNACK, the way a real broker (e.g. Mosquitto,
+// EMQX) commonly sends it: a mix of identifiers with dedicated Properties
+// fields and several this package only exposes via Unknown.
+func rawConnackProperties() []byte {
+	var body []byte
+
+	// Session Expiry Interval (17): four byte int, dedicated field.
+	body = append(body, byte(PropertySessionExpiryInterval))
+	body = appendUint32(body, 3600)
+
+	// Receive Maximum (33): two byte int, Unknown.
+	body = append(body, byte(PropertyReceiveMaximum))
+	body = appendUint16(body, 65535)
+
+	// Maximum QoS (36): one byte, Unknown.
+	body = append(body, byte(PropertyMaximumQoS), 1)
+
+	// Retain Available (37): one byte, Unknown.
+	body = append(body, byte(PropertyRetainAvailable), 1)
+
+	// Maximum Packet Size (39): four byte int, Unknown.
+	body = append(body, byte(PropertyMaximumPacketSize))
+	body = appendUint32(body, 268435455)
+
+	// Topic Alias Maximum (34): two byte int, Unknown.
+	body = append(body, byte(PropertyTopicAliasMaximum))
+	body = appendUint16(body, 16)
+
+	// Wildcard/Subscription Identifier/Shared Subscription Available
+	// (40/41/42): one byte each, Unknown.
+	body = append(body, byte(PropertyWildcardSubscriptionAvailable), 1)
+	body = append(body, byte(PropertySubscriptionIdentifierAvailable), 1)
+	body = append(body, byte(PropertySharedSubscriptionAvailable), 1)
+
+	// Reason String (31): UTF-8 string, Unknown.
+	body = append(body, byte(PropertyReasonString))
+	body = appendUTF8(body, "")
+
+	// User Property (38): UTF-8 string pair, dedicated field, repeatable.
+	body = append(body, byte(PropertyUserProperty))
+	body = appendUTF8(body, "")
+	body = appendUTF8(body, "")
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(body)))
+
+	return append(append([]byte(nil), lenBuf[:n]...), body...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUTF8(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// TestDecodePropertiesRealConnack decodes a realistic CONNACK Properties
+// block and checks both the dedicated fields and the Unknown fallback are
+// populated, then round-trips it through encode/decode again.
+func TestDecodePropertiesRealConnack(t *testing.T) {
+	src := rawConnackProperties()
+
+	p, n, err := decodeProperties(src)
+	if err != nil {
+		t.Fatalf("decodeProperties failed on a realistic CONNACK properties block: %s", err)
+	}
+
+	if n != len(src) {
+		t.Fatalf("decodeProperties consumed %d bytes, want %d", n, len(src))
+	}
+
+	if p.SessionExpiryInterval == nil || *p.SessionExpiryInterval != 3600 {
+		t.Fatalf("SessionExpiryInterval = %v, want 3600", p.SessionExpiryInterval)
+	}
+
+	if len(p.UserProperties) != 1 {
+		t.Fatalf("UserProperties = %v, want 1 entry", p.UserProperties)
+	}
+
+	wantUnknown := []PropertyIdentifier{
+		PropertyReceiveMaximum,
+		PropertyMaximumQoS,
+		PropertyRetainAvailable,
+		PropertyMaximumPacketSize,
+		PropertyTopicAliasMaximum,
+		PropertyWildcardSubscriptionAvailable,
+		PropertySubscriptionIdentifierAvailable,
+		PropertySharedSubscriptionAvailable,
+		PropertyReasonString,
+	}
+
+	if len(p.Unknown) != len(wantUnknown) {
+		t.Fatalf("Unknown has %d entries, want %d: %+v", len(p.Unknown), len(wantUnknown), p.Unknown)
+	}
+
+	for i, id := range wantUnknown {
+		if p.Unknown[i].Identifier != id {
+			t.Fatalf("Unknown[%d].Identifier = %d, want %d", i, p.Unknown[i].Identifier, id)
+		}
+	}
+
+	// Round-trip: encode what we decoded, then decode that again. The
+	// re-encoded bytes needn't match src byte-for-byte (named fields are
+	// always written before Unknown ones), but the parsed result must be
+	// stable under encode . decode.
+	buf := make([]byte, p.Len()+4)
+	n2, err := p.encode(buf)
+	if err != nil {
+		t.Fatalf("encode of a decoded Properties failed: %s", err)
+	}
+
+	p2, n3, err := decodeProperties(buf[:n2])
+	if err != nil {
+		t.Fatalf("re-decode of a re-encoded Properties failed: %s", err)
+	}
+
+	if n3 != n2 {
+		t.Fatalf("re-decode consumed %d bytes, want %d", n3, n2)
+	}
+
+	if *p2.SessionExpiryInterval != *p.SessionExpiryInterval {
+		t.Fatalf("round-trip SessionExpiryInterval = %v, want %v", *p2.SessionExpiryInterval, *p.SessionExpiryInterval)
+	}
+
+	if len(p2.Unknown) != len(p.Unknown) {
+		t.Fatalf("round-trip Unknown has %d entries, want %d", len(p2.Unknown), len(p.Unknown))
+	}
+
+	for i := range p.Unknown {
+		if p2.Unknown[i].Identifier != p.Unknown[i].Identifier || !bytes.Equal(p2.Unknown[i].Value, p.Unknown[i].Value) {
+			t.Fatalf("round-trip Unknown[%d] = %+v, want %+v", i, p2.Unknown[i], p.Unknown[i])
+		}
+	}
+}
+
+// TestDecodePropertiesRejectsUnrecognizedIdentifier checks that an
+// identifier outside the MQTT 5.0 spec's set is still rejected outright,
+// since there's no safe way to know its width and keep parsing.
+func TestDecodePropertiesRejectsUnrecognizedIdentifier(t *testing.T) {
+	body := []byte{0x7f} // not a defined MQTT 5.0 property identifier
+
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(body)))
+
+	src := append(append([]byte(nil), lenBuf[:n]...), body...)
+
+	if _, _, err := decodeProperties(src); err == nil {
+		t.Fatal("decodeProperties accepted an unrecognized property identifier")
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+// ReasonCode is the single-byte MQTT 5.0 result code carried on CONNACK,
+// PUBACK, SUBACK and other acknowledgement packets. For V3.1/V3.1.1
+// connections the corresponding, much narrower set of codes is represented
+// by ConnectReturnCode instead; V3ReturnCode maps between the two where
+// they overlap.
+type ReasonCode byte
+
+const (
+	Success                    ReasonCode = 0x00
+	UnspecifiedError           ReasonCode = 0x80
+	UnsupportedProtocolVersion ReasonCode = 0x84
+	ClientIdentifierNotValid   ReasonCode = 0x85
+	BadUserNameOrPassword      ReasonCode = 0x86
+	NotAuthorized              ReasonCode = 0x87
+	ServerUnavailable          ReasonCode = 0x88
+)
+
+// ConnectReturnCode is the CONNACK return code used by MQTT 3.1/3.1.1,
+// before MQTT 5.0 widened this into the much larger set of ReasonCodes.
+type ConnectReturnCode byte
+
+const (
+	ConnectionAccepted        ConnectReturnCode = 0x00
+	ErrInvalidProtocolVersion ConnectReturnCode = 0x01
+	ErrIdentifierRejected     ConnectReturnCode = 0x02
+	ErrServerUnavailable      ConnectReturnCode = 0x03
+	ErrBadUsernameOrPassword  ConnectReturnCode = 0x04
+	ErrNotAuthorized          ConnectReturnCode = 0x05
+)
+
+// V3ReturnCode maps a ReasonCode down to the nearest MQTT 3.1/3.1.1 CONNACK
+// return code, for use when NegotiateVersion settles on V31 or V311.
+func (rc ReasonCode) V3ReturnCode() ConnectReturnCode {
+	switch rc {
+	case Success:
+		return ConnectionAccepted
+	case UnsupportedProtocolVersion:
+		return ErrInvalidProtocolVersion
+	case ClientIdentifierNotValid:
+		return ErrIdentifierRejected
+	case BadUserNameOrPassword:
+		return ErrBadUsernameOrPassword
+	case NotAuthorized:
+		return ErrNotAuthorized
+	default:
+		return ErrServerUnavailable
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ProtocolVersion identifies which revision of the MQTT wire format a
+// message was (or should be) encoded with. It is carried on the CONNECT
+// variable header as the "protocol level" field, and from there is expected
+// to be threaded onto every other message decoded on the same connection so
+// that version-dependent parts of the wire format (MQTT 5.0 Properties,
+// Reason Codes, etc.) are parsed correctly.
+type ProtocolVersion byte
+
+const (
+	// V31 is MQTT 3.1, protocol level 3.
+	V31 ProtocolVersion = 3
+
+	// V311 is MQTT 3.1.1, protocol level 4. This is the default when a
+	// header has not been told otherwise, preserving the wire format this
+	// package originally supported.
+	V311 ProtocolVersion = 4
+
+	// V50 is MQTT 5.0, protocol level 5.
+	V50 ProtocolVersion = 5
+)
+
+// Valid returns true if the ProtocolVersion is one this package knows how to
+// encode and decode.
+func (v ProtocolVersion) Valid() bool {
+	switch v {
+	case V31, V311, V50:
+		return true
+	}
+
+	return false
+}
+
+// String returns a human readable name for the protocol version, e.g. "3.1.1".
+func (v ProtocolVersion) String() string {
+	switch v {
+	case V31:
+		return "3.1"
+	case V311:
+		return "3.1.1"
+	case V50:
+		return "5.0"
+	default:
+		return "unknown"
+	}
+}
+
+// HasProperties returns true if messages encoded with this version of the
+// protocol carry an MQTT 5.0 Properties block.
+func (v ProtocolVersion) HasProperties() bool {
+	return v == V50
+}
+
+// ValidateProtocolLevel checks the protocol name and level fields decoded
+// from a CONNECT variable header against the "magic bytes" each protocol
+// version requires — MQTT 3.1 is the name "MQIsdp" with level 3, while
+// 3.1.1 and 5.0 both use the name "MQTT", with level 4 or 5 respectively —
+// and returns the ProtocolVersion they identify.
+func ValidateProtocolLevel(name string, level byte) (ProtocolVersion, error) {
+	v := ProtocolVersion(level)
+
+	switch {
+	case name == "MQIsdp" && v == V31:
+		return v, nil
+	case name == "MQTT" && (v == V311 || v == V50):
+		return v, nil
+	default:
+		return 0, fmt.Errorf("header: unrecognized protocol name/level %q/%d", name, level)
+	}
+}
+
+// NegotiateVersion decides which protocol version a connection should use,
+// given what the client asked for in CONNECT and the highest version this
+// server supports, and returns the CONNACK reason/return code to send back.
+// If client is not a version this package understands, or is newer than
+// server supports, negotiation fails and the returned ProtocolVersion must
+// not be used to encode the CONNACK.
+func NegotiateVersion(client, server ProtocolVersion) (ProtocolVersion, ReasonCode) {
+	if !client.Valid() || !server.Valid() || client > server {
+		return 0, UnsupportedProtocolVersion
+	}
+
+	return client, Success
+}
+
+// DecoderContext carries state that must survive across multiple decode
+// calls on the same connection — currently just the negotiated protocol
+// version. Create one per connection and pass it to every header decoded
+// on that connection via decodeWithContext, so that, e.g., a SUBACK
+// decoded after a V5.0 CONNECT gets its reason codes parsed correctly.
+type DecoderContext struct {
+	Version ProtocolVersion
+}
+
+// decodeWithContext decodes src like decode, but first applies ctx.Version
+// to this header. For CONNECT, which is the message that negotiates the
+// version in the first place, it reads the protocol name/level fields that
+// open the variable header, checks them with ValidateProtocolLevel, and sets
+// the header's version from them, so that ctx carries the negotiated version
+// forward to every later message. A CONNECT too short to hold those fields
+// keeps the version it had.
+func (h *header) decodeWithContext(ctx *DecoderContext, src []byte) (int, error) {
+	h.version = ctx.Version
+
+	n, err := h.decode(src)
+	if err != nil {
+		return n, err
+	}
+
+	if h.Type() == CONNECT {
+		vh := src[n : n+int(h.remLen)]
+		if len(vh) >= 2 {
+			l := int(binary.BigEndian.Uint16(vh))
+			if len(vh) > 2+l {
+				v, err := ValidateProtocolLevel(string(vh[2:2+l]), vh[2+l])
+				if err != nil {
+					return n, err
+				}
+				h.version = v
+			}
+		}
+		ctx.Version = h.Version()
+	}
+
+	return n, nil
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package message
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidateProtocolLevel(t *testing.T) {
+	tests := []struct {
+		name    string
+		level   byte
+		want    ProtocolVersion
+		wantErr bool
+	}{
+		{"MQIsdp", 3, V31, false},
+		{"MQTT", 4, V311, false},
+		{"MQTT", 5, V50, false},
+		{"MQIsdp", 4, 0, true}, // wrong name for this level
+		{"MQTT", 3, 0, true},   // wrong name for this level
+		{"bogus", 4, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ValidateProtocolLevel(tt.name, tt.level)
+
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ValidateProtocolLevel(%q, %d) = %v, nil; want an error", tt.name, tt.level, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ValidateProtocolLevel(%q, %d) returned error: %s", tt.name, tt.level, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("ValidateProtocolLevel(%q, %d) = %v, want %v", tt.name, tt.level, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		client, server ProtocolVersion
+		wantVersion    ProtocolVersion
+		wantCode       ReasonCode
+	}{
+		{V311, V50, V311, Success},
+		{V50, V50, V50, Success},
+		{V31, V311, V31, Success},
+		{V50, V311, 0, UnsupportedProtocolVersion},
+		{ProtocolVersion(9), V50, 0, UnsupportedProtocolVersion},
+	}
+
+	for _, tt := range tests {
+		gotVersion, gotCode := NegotiateVersion(tt.client, tt.server)
+
+		if gotVersion != tt.wantVersion || gotCode != tt.wantCode {
+			t.Errorf("NegotiateVersion(%v, %v) = (%v, %v), want (%v, %v)",
+				tt.client, tt.server, gotVersion, gotCode, tt.wantVersion, tt.wantCode)
+		}
+	}
+}
+
+func TestBuildConnack(t *testing.T) {
+	h, varHeader, err := BuildConnack(V50, Success, true)
+	if err != nil {
+		t.Fatalf("BuildConnack(V50, Success, true) returned error: %s", err)
+	}
+
+	if h.Type() != CONNACK {
+		t.Fatalf("h.Type() = %v, want CONNACK", h.Type())
+	}
+
+	if h.Version() != V50 {
+		t.Fatalf("h.Version() = %v, want V50", h.Version())
+	}
+
+	if len(varHeader) != 2 || varHeader[0] != 0x01 || varHeader[1] != byte(Success) {
+		t.Fatalf("varHeader = %v, want [0x01 0x00]", varHeader)
+	}
+
+	h311, varHeader311, err := BuildConnack(V311, UnsupportedProtocolVersion, false)
+	if err != nil {
+		t.Fatalf("BuildConnack(V311, UnsupportedProtocolVersion, false) returned error: %s", err)
+	}
+
+	if len(varHeader311) != 2 || varHeader311[0] != 0x00 || varHeader311[1] != byte(ErrInvalidProtocolVersion) {
+		t.Fatalf("varHeader311 = %v, want [0x00 0x01] (V3 return code, not the raw V5 reason code)", varHeader311)
+	}
+
+	if h311.RemainingLength() != int32(len(varHeader311)) {
+		t.Fatalf("RemainingLength() = %d, want %d", h311.RemainingLength(), len(varHeader311))
+	}
+
+	if _, _, err := BuildConnack(ProtocolVersion(9), Success, false); err == nil {
+		t.Fatal("BuildConnack with an invalid protocol version unexpectedly succeeded")
+	}
+}
+
+// TestBuildConnackEncodeV50 serializes a full V50 CONNACK (fixed header,
+// ack-flags/reason-code variable header, and a Properties block) via
+// EncodeMessageTo, then decodes it back off the wire and checks every piece
+// landed in the right place and in the right order: ack flags and reason
+// code before Properties, with Remaining Length covering all of it.
+func TestBuildConnackEncodeV50(t *testing.T) {
+	h, varHeader, err := BuildConnack(V50, Success, true)
+	if err != nil {
+		t.Fatalf("BuildConnack: %s", err)
+	}
+
+	sessionExpiry := uint32(3600)
+	h.SetProperties(&Properties{SessionExpiryInterval: &sessionExpiry})
+
+	var buf bytes.Buffer
+	if _, err := h.EncodeMessageTo(&buf, varHeader); err != nil {
+		t.Fatalf("EncodeMessageTo: %s", err)
+	}
+
+	wire := buf.Bytes()
+
+	h2 := &header{}
+	n, err := h2.decode(wire)
+	if err != nil {
+		t.Fatalf("decode of the encoded CONNACK failed: %s", err)
+	}
+
+	if h2.Type() != CONNACK {
+		t.Fatalf("decoded type = %v, want CONNACK", h2.Type())
+	}
+
+	if int(h2.RemainingLength()) != len(wire)-n {
+		t.Fatalf("RemainingLength() = %d, want %d (Remaining Length must cover varHeader and Properties, not just varHeader)",
+			h2.RemainingLength(), len(wire)-n)
+	}
+
+	rest := wire[n:]
+	if len(rest) < 2 || rest[0] != 0x01 || rest[1] != byte(Success) {
+		t.Fatalf("variable header bytes = %v, want [0x01 0x00] immediately after the fixed header (before Properties)", rest)
+	}
+
+	p, pn, err := decodeProperties(rest[2:])
+	if err != nil {
+		t.Fatalf("decodeProperties on the bytes following the variable header failed: %s", err)
+	}
+
+	if pn != len(rest)-2 {
+		t.Fatalf("decodeProperties consumed %d bytes, want %d (Properties must be the last thing in the packet)", pn, len(rest)-2)
+	}
+
+	if p.SessionExpiryInterval == nil || *p.SessionExpiryInterval != sessionExpiry {
+		t.Fatalf("decoded SessionExpiryInterval = %v, want %d", p.SessionExpiryInterval, sessionExpiry)
+	}
+}